@@ -0,0 +1,183 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package client contains the transport-protocol-agnostic pieces of the xDS
+// client: the registry of per-version API clients, and the generic
+// TransportHelper that drives a single ADS stream on their behalf.
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/internal/grpclog"
+	"google.golang.org/grpc/xds/internal/version"
+)
+
+// TransportMode specifies which xDS transport variant an APIClient should
+// speak on its single ADS stream.
+type TransportMode int
+
+const (
+	// TransportModeSotW is the classic state-of-the-world ADS flow, where
+	// every request/response carries the full set of resources of a type.
+	// This is the default when BuildOptions.TransportMode is left unset.
+	TransportModeSotW TransportMode = iota
+	// TransportModeDelta is the incremental (delta) ADS flow, where
+	// request/response messages carry only the resources that changed since
+	// the last one, plus enough bookkeeping (versions, nonces) to resume
+	// correctly across reconnects.
+	TransportModeDelta
+)
+
+// BuildOptions contains the options to be passed to APIClientBuilder.Build.
+type BuildOptions struct {
+	// Parent is a reference to the xdsClient using this API client. API
+	// client implementations need this reference to notify the xdsClient
+	// about updates and errors.
+	Parent UpdateHandler
+	// NodeProto is the node proto to be used in xDS requests, in the
+	// appropriate version (i.e. v2 or v3). This is the proto representation
+	// of the Node returned by the bootstrap process.
+	NodeProto proto.Message
+	// Backoff returns the amount of time to backoff before retrying the ADS
+	// stream, given the number of retries since the last successful stream.
+	Backoff func(int) time.Duration
+	// Logger is the logger used for logging.
+	Logger *grpclog.PrefixLogger
+	// TransportMode selects between the SotW and the incremental (delta)
+	// xDS transport protocol variants for the ADS stream. Defaults to
+	// TransportModeSotW.
+	TransportMode TransportMode
+}
+
+// UpdateHandler receives and processes (by taking appropriate actions, such
+// as updating watchers) xDS resource updates from an APIClient for each
+// resource type.
+type UpdateHandler interface {
+	// NewListeners handles updates to LDS resources.
+	NewListeners(interface{})
+	// NewRouteConfigs handles updates to RDS resources.
+	NewRouteConfigs(interface{})
+	// NewClusters handles updates to CDS resources.
+	NewClusters(interface{})
+	// NewEndpoints handles updates to EDS resources.
+	NewEndpoints(interface{})
+	// OnStreamError is invoked when the underlying ADS stream breaks, or
+	// when the management server explicitly removes a resource being
+	// watched. It lets watchers stop relying on stale resources instead of
+	// serving them until the stream backs off and reconnects.
+	OnStreamError(error)
+}
+
+// ErrResourceTypeUnsupported is an error used to indicate an invalid resource
+// type being requested/received from the xDS server.
+type ErrResourceTypeUnsupported struct {
+	// ErrStr holds the error string.
+	ErrStr string
+}
+
+// Error helps implement the error interface.
+func (e ErrResourceTypeUnsupported) Error() string {
+	return e.ErrStr
+}
+
+// APIClient represents the functionality required to communicate with the
+// management server using a specific version of the xDS transport protocol.
+// One is created for every version of the transport protocol supported by
+// the client.
+//
+// It contains the logic to send requests and receive responses on the
+// single ADS stream managed by TransportHelper, in whichever of the SotW or
+// delta wire formats the APIClient was built for.
+type APIClient interface {
+	// AddWatch adds a watch for an xDS resource given its type and name.
+	AddWatch(resourceType, resourceName string)
+	// RemoveWatch cancels an already registered watch for an xDS resource
+	// given its type and name.
+	RemoveWatch(resourceType, resourceName string)
+	// NewStream returns a new xDS client stream specific to the underlying
+	// transport protocol version.
+	NewStream(ctx context.Context) (grpc.ClientStream, error)
+
+	// SendRequest constructs and sends out a DiscoveryRequest message
+	// specific to the underlying transport protocol version. nackErr is the
+	// resource validation error that caused this to be a nack, and is nil
+	// for new requests and acks.
+	SendRequest(s grpc.ClientStream, resourceNames []string, resourceType, version, nonce string, nackErr error) error
+	// RecvResponse blocks on the receipt of one response message on the
+	// provided stream.
+	RecvResponse(s grpc.ClientStream) (proto.Message, error)
+	// HandleResponse parses and validates the received response, hands the
+	// update to the parent UpdateHandler, and returns the type, version and
+	// nonce of the received response, as well as the validation error, if
+	// any.
+	HandleResponse(proto.Message) (resourceType, version, nonce string, err error)
+
+	// SendDeltaRequest, RecvDeltaResponse and HandleDeltaResponse mirror the
+	// above, but for the incremental (delta) xDS transport variant.
+	// initialStream, when true, tells the APIClient this is the first
+	// request for resourceType since the stream was (re)established, so it
+	// should populate InitialResourceVersions from whatever it cached
+	// before the disconnect.
+	SendDeltaRequest(s grpc.ClientStream, resourceType, nonce string, initialStream bool, nackErr error) error
+	RecvDeltaResponse(s grpc.ClientStream) (proto.Message, error)
+	HandleDeltaResponse(proto.Message) (resourceType, nonce string, err error)
+}
+
+// APIClientBuilder creates an xDS client for a specific xDS transport
+// protocol version.
+type APIClientBuilder interface {
+	// Build builds a transport protocol specific implementation of the
+	// APIClient interface using the provided grpc.ClientConn.
+	Build(cc *grpc.ClientConn, opts BuildOptions) (APIClient, error)
+	// Version returns the transport protocol version used by clients built
+	// using this builder.
+	Version() version.TransportAPI
+}
+
+var apiClientBuilders = map[version.TransportAPI]APIClientBuilder{}
+
+// RegisterAPIClientBuilder registers an implementation of the APIClient
+// interface for a particular xDS transport protocol version.
+//
+// NOTE: this function must only be called during initialization time (i.e.
+// in an init() function), and is not thread-safe.
+func RegisterAPIClientBuilder(b APIClientBuilder) {
+	apiClientBuilders[b.Version()] = b
+}
+
+// getAPIClientBuilder returns the registered builder for the given version,
+// or nil if there isn't one.
+func getAPIClientBuilder(ver version.TransportAPI) APIClientBuilder {
+	if b, ok := apiClientBuilders[ver]; ok {
+		return b
+	}
+	return nil
+}
+
+func newAPIClient(ver version.TransportAPI, cc *grpc.ClientConn, opts BuildOptions) (APIClient, error) {
+	b := getAPIClientBuilder(ver)
+	if b == nil {
+		return nil, fmt.Errorf("xds: no APIClient registered for version %v", ver)
+	}
+	return b.Build(cc, opts)
+}
@@ -0,0 +1,295 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/internal/grpclog"
+)
+
+// TransportHelper manages the single ADS stream used to communicate with the
+// management server: creating it, retrying with backoff across disconnects,
+// and multiplexing requests/responses for every watched resource type and
+// name onto it. The version-specific APIClient (v2 or v3) plugs into this
+// through the APIClient interface, supplying the wire-format-specific
+// send/recv/parse logic; TransportHelper itself only needs to know whether
+// that APIClient was built to speak the SotW or the delta variant.
+//
+// grpc.ClientStream forbids calling SendMsg from more than one goroutine at
+// a time, so sendLoop is the only goroutine that ever calls stream.Send (via
+// sendRequest); recvAndHandle, which runs on the stream's own goroutine,
+// only ever records what needs sending next and wakes sendLoop up to do it.
+type TransportHelper struct {
+	cli     APIClient
+	logger  *grpclog.PrefixLogger
+	backoff func(int) time.Duration
+	mode    TransportMode
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// updateCh is signaled (non-blocking) whenever AddWatch/RemoveWatch, or a
+	// received response needing an ack/nack, add to dirtyTypes, so the
+	// active stream's send loop wakes up and pushes out new requests.
+	updateCh chan struct{}
+
+	mu         sync.Mutex
+	watchMap   map[string]map[string]bool // resourceType -> resourceName -> true
+	versionMap map[string]string          // resourceType -> last acked version (SotW only)
+	nonceMap   map[string]string          // resourceType -> last received nonce
+	sentFirst  map[string]bool            // resourceType -> an initial request was already sent on the current stream
+	dirtyTypes map[string]bool            // resourceType -> sendLoop owes it a request
+	nackErrs   map[string]error           // resourceType -> validation error of the ack/nack sendLoop owes it, if any
+}
+
+// NewTransportHelper creates a new transport helper to be used by a
+// version-specific APIClient implementation.
+func NewTransportHelper(cli APIClient, logger *grpclog.PrefixLogger, backoff func(int) time.Duration, mode TransportMode) *TransportHelper {
+	t := &TransportHelper{
+		cli:        cli,
+		logger:     logger,
+		backoff:    backoff,
+		mode:       mode,
+		updateCh:   make(chan struct{}, 1),
+		watchMap:   make(map[string]map[string]bool),
+		versionMap: make(map[string]string),
+		nonceMap:   make(map[string]string),
+		sentFirst:  make(map[string]bool),
+		dirtyTypes: make(map[string]bool),
+		nackErrs:   make(map[string]error),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	go t.run(t.ctx)
+	return t
+}
+
+// AddWatch adds a watch for an xDS resource given its type and name.
+func (t *TransportHelper) AddWatch(resourceType, resourceName string) {
+	t.mu.Lock()
+	if t.watchMap[resourceType] == nil {
+		t.watchMap[resourceType] = make(map[string]bool)
+	}
+	t.watchMap[resourceType][resourceName] = true
+	t.dirtyTypes[resourceType] = true
+	t.mu.Unlock()
+	t.wakeSendLocked()
+}
+
+// RemoveWatch cancels an already registered watch for an xDS resource given
+// its type and name.
+func (t *TransportHelper) RemoveWatch(resourceType, resourceName string) {
+	t.mu.Lock()
+	delete(t.watchMap[resourceType], resourceName)
+	t.dirtyTypes[resourceType] = true
+	t.mu.Unlock()
+	t.wakeSendLocked()
+}
+
+// wakeSendLocked nudges the send loop of whatever stream is currently
+// active. It's safe to call with or without the stream up; if there's no
+// active stream the signal is simply picked up once one is (re)established.
+func (t *TransportHelper) wakeSendLocked() {
+	select {
+	case t.updateCh <- struct{}{}:
+	default:
+	}
+}
+
+// Close cancels the helper's context, tearing down the ADS stream. Recv
+// failures caused by this shutdown must not be reported to watchers as
+// stream errors, since there's nothing unexpected about a stream closing
+// because the client was closed.
+func (t *TransportHelper) Close() {
+	t.cancel()
+}
+
+// run manages the lifecycle of the ADS stream: establishing it, running it
+// until it breaks, and retrying with backoff, until the helper is closed.
+func (t *TransportHelper) run(ctx context.Context) {
+	retries := 0
+	for ctx.Err() == nil {
+		stream, err := t.cli.NewStream(ctx)
+		if err != nil {
+			t.logger.Warningf("xds: ADS stream creation failed: %v", err)
+			t.backoffBeforeRetry(ctx, retries)
+			retries++
+			continue
+		}
+		retries = 0
+		t.mu.Lock()
+		t.sentFirst = make(map[string]bool)
+		t.mu.Unlock()
+
+		t.runStream(ctx, stream)
+		t.backoffBeforeRetry(ctx, retries)
+	}
+}
+
+func (t *TransportHelper) backoffBeforeRetry(ctx context.Context, retries int) {
+	timer := time.NewTimer(t.backoff(retries))
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+}
+
+// runStream marks every currently watched resource type dirty so sendLoop
+// (the only goroutine allowed to write to the stream) sends their initial
+// requests, then alternates sendLoop pushing out requests against
+// recvAndHandle receiving and queueing ACKs/NACKs, until the stream breaks
+// or ctx is cancelled.
+func (t *TransportHelper) runStream(ctx context.Context, stream grpc.ClientStream) {
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+
+	t.mu.Lock()
+	for resourceType := range t.watchMap {
+		t.dirtyTypes[resourceType] = true
+	}
+	t.mu.Unlock()
+
+	go t.sendLoop(streamCtx, cancelStream, stream)
+	t.wakeSendLocked()
+
+	for {
+		if err := t.recvAndHandle(stream); err != nil {
+			// RecvResponse/RecvDeltaResponse already notified the parent of
+			// the broken stream (guarding against the Close()/ctx-cancelled
+			// case themselves); we just need to stop this stream's loops
+			// and let run() retry with backoff.
+			return
+		}
+	}
+}
+
+// sendLoop is the only goroutine that calls stream.Send (through
+// sendRequest): on every updateCh signal, it sends exactly one request per
+// resource type that AddWatch/RemoveWatch or recvAndHandle marked dirty
+// since the last request for that type, carrying whatever nackErr
+// recvAndHandle queued for it. If a send fails, sendLoop calls cancel, which
+// tears down streamCtx and stops sendLoop; the stream itself was opened on
+// run's ctx, so this does not interrupt a Recv that recvAndHandle is blocked
+// in.
+func (t *TransportHelper) sendLoop(ctx context.Context, cancel context.CancelFunc, stream grpc.ClientStream) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.updateCh:
+		}
+		t.mu.Lock()
+		types := make([]string, 0, len(t.dirtyTypes))
+		for resourceType := range t.dirtyTypes {
+			types = append(types, resourceType)
+			delete(t.dirtyTypes, resourceType)
+		}
+		t.mu.Unlock()
+		for _, resourceType := range types {
+			t.mu.Lock()
+			nackErr := t.nackErrs[resourceType]
+			delete(t.nackErrs, resourceType)
+			t.mu.Unlock()
+			if err := t.sendRequest(stream, resourceType, nackErr); err != nil {
+				t.logger.Warningf("xds: failed to send request for %v: %v", resourceType, err)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// sendRequest sends a request for resourceType (a new request, an ack, or,
+// when nackErr is non-nil, a nack), carrying the last acked version and the
+// last received nonce, in whichever wire format the underlying APIClient
+// speaks.
+func (t *TransportHelper) sendRequest(stream grpc.ClientStream, resourceType string, nackErr error) error {
+	t.mu.Lock()
+	names := make([]string, 0, len(t.watchMap[resourceType]))
+	for name := range t.watchMap[resourceType] {
+		names = append(names, name)
+	}
+	ackVersion := t.versionMap[resourceType]
+	nonce := t.nonceMap[resourceType]
+	initial := !t.sentFirst[resourceType]
+	t.sentFirst[resourceType] = true
+	t.mu.Unlock()
+
+	if t.mode == TransportModeDelta {
+		return t.cli.SendDeltaRequest(stream, resourceType, nonce, initial, nackErr)
+	}
+	return t.cli.SendRequest(stream, names, resourceType, ackVersion, nonce, nackErr)
+}
+
+// recvAndHandle blocks for one response, hands it to the APIClient for
+// parsing, and, based on the outcome, queues an ACK or NACK for sendLoop to
+// send.
+func (t *TransportHelper) recvAndHandle(stream grpc.ClientStream) error {
+	var (
+		resourceType string
+		newVersion   string
+		nonce        string
+		handleErr    error
+	)
+	if t.mode == TransportModeDelta {
+		resp, err := t.cli.RecvDeltaResponse(stream)
+		if err != nil {
+			return err
+		}
+		resourceType, nonce, handleErr = t.cli.HandleDeltaResponse(resp)
+	} else {
+		resp, err := t.cli.RecvResponse(stream)
+		if err != nil {
+			return err
+		}
+		resourceType, newVersion, nonce, handleErr = t.cli.HandleResponse(resp)
+	}
+
+	var rtErr ErrResourceTypeUnsupported
+	if errors.As(handleErr, &rtErr) {
+		t.logger.Warningf("xds: %v", rtErr)
+		return nil
+	}
+
+	t.mu.Lock()
+	t.nonceMap[resourceType] = nonce
+	if handleErr == nil {
+		t.versionMap[resourceType] = newVersion
+		delete(t.nackErrs, resourceType)
+	} else {
+		// handleErr is the resource validation error that makes this a nack;
+		// stashing it here lets sendLoop surface it to the management server
+		// as the request's ErrorDetail instead of leaving it to infer a nack
+		// purely from the version not advancing.
+		t.nackErrs[resourceType] = handleErr
+	}
+	t.dirtyTypes[resourceType] = true
+	t.mu.Unlock()
+
+	// recvAndHandle must never call stream.Send itself - see the comment on
+	// TransportHelper - so the ack/nack for this response is queued above
+	// for sendLoop, the only goroutine that sends, to pick up.
+	t.wakeSendLocked()
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeAPIClient is a minimal APIClient used to observe which of the SotW or
+// delta send paths TransportHelper drives, and what nackErr it's given,
+// without needing a real ADS stream. handleResponseErr/handleDeltaErr let a
+// test simulate a resource validation failure coming out of HandleResponse.
+type fakeAPIClient struct {
+	sendRequestCalls      int
+	sendDeltaRequestCalls int
+	lastNackErr           error
+
+	handleResponseErr error
+	handleDeltaErr    error
+
+	// sent, if non-nil, receives the resourceType of every SendRequest/
+	// SendDeltaRequest call, so a test can synchronize on a send having
+	// happened instead of sleeping.
+	sent chan string
+}
+
+func (f *fakeAPIClient) AddWatch(string, string)    {}
+func (f *fakeAPIClient) RemoveWatch(string, string) {}
+func (f *fakeAPIClient) NewStream(context.Context) (grpc.ClientStream, error) {
+	return nil, nil
+}
+func (f *fakeAPIClient) SendRequest(_ grpc.ClientStream, _ []string, resourceType, _, _ string, nackErr error) error {
+	f.sendRequestCalls++
+	f.lastNackErr = nackErr
+	if f.sent != nil {
+		f.sent <- resourceType
+	}
+	return nil
+}
+func (f *fakeAPIClient) RecvResponse(grpc.ClientStream) (proto.Message, error) { return new(emptyMsg), nil }
+func (f *fakeAPIClient) HandleResponse(proto.Message) (string, string, string, error) {
+	return "type.A", "1", "nonce-1", f.handleResponseErr
+}
+func (f *fakeAPIClient) SendDeltaRequest(_ grpc.ClientStream, resourceType, _ string, _ bool, nackErr error) error {
+	f.sendDeltaRequestCalls++
+	f.lastNackErr = nackErr
+	if f.sent != nil {
+		f.sent <- resourceType
+	}
+	return nil
+}
+func (f *fakeAPIClient) RecvDeltaResponse(grpc.ClientStream) (proto.Message, error) {
+	return new(emptyMsg), nil
+}
+func (f *fakeAPIClient) HandleDeltaResponse(proto.Message) (string, string, error) {
+	return "type.A", "nonce-1", f.handleDeltaErr
+}
+
+// emptyMsg is a throwaway proto.Message so fakeAPIClient's Recv methods have
+// something non-nil to hand to Handle*Response.
+type emptyMsg struct{ proto.Message }
+
+// TestTransportHelperSendRequestModeDispatch verifies that sendRequest drives
+// SendRequest for SotW and SendDeltaRequest for delta mode, never both.
+func TestTransportHelperSendRequestModeDispatch(t *testing.T) {
+	for _, tt := range []struct {
+		mode      TransportMode
+		wantSotW  int
+		wantDelta int
+	}{
+		{mode: TransportModeSotW, wantSotW: 1, wantDelta: 0},
+		{mode: TransportModeDelta, wantSotW: 0, wantDelta: 1},
+	} {
+		cli := &fakeAPIClient{}
+		th := &TransportHelper{
+			cli:        cli,
+			mode:       tt.mode,
+			watchMap:   map[string]map[string]bool{"type.A": {"res-1": true}},
+			versionMap: make(map[string]string),
+			nonceMap:   make(map[string]string),
+			sentFirst:  make(map[string]bool),
+		}
+		if err := th.sendRequest(nil, "type.A", nil); err != nil {
+			t.Fatalf("sendRequest() failed: %v", err)
+		}
+		if cli.sendRequestCalls != tt.wantSotW || cli.sendDeltaRequestCalls != tt.wantDelta {
+			t.Errorf("mode %v: got SendRequest calls=%d, SendDeltaRequest calls=%d; want %d, %d",
+				tt.mode, cli.sendRequestCalls, cli.sendDeltaRequestCalls, tt.wantSotW, tt.wantDelta)
+		}
+	}
+}
+
+// TestRecvAndHandlePlumbsNackErr verifies that recvAndHandle, on finding that
+// HandleResponse/HandleDeltaResponse returned a validation error, stashes
+// that same error as the resource type's pending nackErr and marks it dirty
+// for sendLoop - rather than discarding it, or sending it itself (recvAndHandle
+// must never call stream.Send; only sendLoop may, since grpc.ClientStream
+// forbids concurrent sends).
+func TestRecvAndHandlePlumbsNackErr(t *testing.T) {
+	wantErr := errors.New("bad resource: missing field foo")
+	for _, tt := range []struct {
+		mode TransportMode
+	}{
+		{mode: TransportModeSotW},
+		{mode: TransportModeDelta},
+	} {
+		cli := &fakeAPIClient{handleResponseErr: wantErr, handleDeltaErr: wantErr}
+		th := &TransportHelper{
+			cli:        cli,
+			mode:       tt.mode,
+			watchMap:   map[string]map[string]bool{"type.A": {"res-1": true}},
+			versionMap: make(map[string]string),
+			nonceMap:   make(map[string]string),
+			sentFirst:  make(map[string]bool),
+			dirtyTypes: make(map[string]bool),
+			nackErrs:   make(map[string]error),
+			updateCh:   make(chan struct{}, 1),
+		}
+		if err := th.recvAndHandle(nil); err != nil {
+			t.Fatalf("mode %v: recvAndHandle() failed: %v", tt.mode, err)
+		}
+		if cli.sendRequestCalls != 0 || cli.sendDeltaRequestCalls != 0 {
+			t.Errorf("mode %v: recvAndHandle() called SendRequest/SendDeltaRequest directly; only sendLoop may", tt.mode)
+		}
+		if got := th.nackErrs["type.A"]; got != wantErr {
+			t.Errorf("mode %v: nackErrs[type.A] = %v, want %v", tt.mode, got, wantErr)
+		}
+		if !th.dirtyTypes["type.A"] {
+			t.Errorf("mode %v: dirtyTypes[type.A] = false, want true", tt.mode)
+		}
+	}
+}
+
+// TestSendLoopSendsOnlyDirtyTypes verifies that sendLoop, on a single wake,
+// sends a request for each type marked dirty and none of the others -
+// confirming an AddWatch/RemoveWatch/ack for one resource type doesn't
+// re-trigger requests for unrelated watched types.
+func TestSendLoopSendsOnlyDirtyTypes(t *testing.T) {
+	cli := &fakeAPIClient{sent: make(chan string, 2)}
+	th := &TransportHelper{
+		cli:  cli,
+		mode: TransportModeSotW,
+		watchMap: map[string]map[string]bool{
+			"type.A": {"res-1": true},
+			"type.B": {"res-2": true},
+		},
+		versionMap: make(map[string]string),
+		nonceMap:   make(map[string]string),
+		sentFirst:  make(map[string]bool),
+		dirtyTypes: map[string]bool{"type.A": true},
+		nackErrs:   make(map[string]error),
+		updateCh:   make(chan struct{}, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		th.sendLoop(ctx, cancel, nil)
+		close(done)
+	}()
+	th.updateCh <- struct{}{}
+
+	select {
+	case got := <-cli.sent:
+		if got != "type.A" {
+			t.Errorf("sendLoop sent a request for %q, want only the dirty type.A", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sendLoop to send the dirty type")
+	}
+
+	// No second send should follow for the untouched type.B.
+	select {
+	case got := <-cli.sent:
+		t.Errorf("sendLoop sent an unexpected extra request for %q", got)
+	default:
+	}
+
+	cancel()
+	<-done
+}
@@ -21,12 +21,17 @@ package v3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/internal/grpclog"
+	grpcstatus "google.golang.org/grpc/status"
 	xdsclient "google.golang.org/grpc/xds/internal/client"
 	"google.golang.org/grpc/xds/internal/version"
 
@@ -55,28 +60,33 @@ func newClient(cc *grpc.ClientConn, opts xdsclient.BuildOptions) (xdsclient.APIC
 		return nil, fmt.Errorf("xds: unsupported Node proto type: %T, want %T", opts.NodeProto, v3corepb.Node{})
 	}
 	v3c := &client{
-		cc:        cc,
-		parent:    opts.Parent,
-		nodeProto: nodeProto,
-		logger:    opts.Logger,
+		cc:               cc,
+		parent:           opts.Parent,
+		nodeProto:        nodeProto,
+		logger:           opts.Logger,
+		mode:             opts.TransportMode,
+		resourceVersions: make(map[string]map[string]string),
+		resourceCache:    make(map[string]map[string]*anypb.Any),
 	}
-	v3c.ctx, v3c.cancelCtx = context.WithCancel(context.Background())
-	v3c.TransportHelper = xdsclient.NewTransportHelper(v3c, opts.Logger, opts.Backoff)
+	v3c.TransportHelper = xdsclient.NewTransportHelper(v3c, opts.Logger, opts.Backoff, opts.TransportMode)
 	return v3c, nil
 }
 
 type adsStream v3adsgrpc.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+type deltaAdsStream v3adsgrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesClient
 
 // client performs the actual xDS RPCs using the xDS v3 API. It creates a
 // single ADS stream on which the different types of xDS requests and responses
-// are multiplexed.
+// are multiplexed. Depending on mode, the stream either carries the
+// state-of-the-world (SotW) `DiscoveryRequest`/`DiscoveryResponse` messages,
+// or the incremental (delta) `DeltaDiscoveryRequest`/`DeltaDiscoveryResponse`
+// messages.
 type client struct {
 	*xdsclient.TransportHelper
 
-	ctx       context.Context
-	cancelCtx context.CancelFunc
-	parent    xdsclient.UpdateHandler
-	logger    *grpclog.PrefixLogger
+	parent xdsclient.UpdateHandler
+	logger *grpclog.PrefixLogger
+	mode   xdsclient.TransportMode
 
 	// ClientConn to the xDS gRPC server. Owned by the parent xdsClient.
 	cc        *grpc.ClientConn
@@ -90,6 +100,26 @@ type client struct {
 	// processing needs this to do the host matching.
 	ldsResourceName string
 	ldsWatchCount   int
+
+	// resourceVersions tracks, for the delta mode, the last version accepted
+	// for each resource of each type (typeURL -> resourceName -> version).
+	// It is used to populate InitialResourceVersions when the ADS stream is
+	// resumed after a disconnect, so the management server can send only the
+	// resources that changed since our last good state.
+	resourceVersions map[string]map[string]string
+	// resourceCache mirrors resourceVersions, but holds the actual resource
+	// proto last accepted for each name (typeURL -> resourceName -> proto).
+	// Because a delta response only carries what changed, this is what lets
+	// handleXXXDeltaResponse hand the per-type unmarshal functions the full,
+	// current set of resources - with removed ones genuinely absent - rather
+	// than just the ones that happened to change in the latest response.
+	resourceCache map[string]map[string]*anypb.Any
+	// pendingSubscriptions and pendingUnsubscriptions record the resource
+	// names that AddWatch/RemoveWatch have queued for the next delta request
+	// of each type, since unlike SotW, delta requests only carry the names
+	// that changed subscription state, not the full set being watched.
+	pendingSubscriptions   map[string][]string
+	pendingUnsubscriptions map[string][]string
 }
 
 // AddWatch overrides the transport helper's AddWatch to save the LDS
@@ -108,6 +138,9 @@ func (v3c *client) AddWatch(resourceType, resourceName string) {
 			v3c.ldsResourceName = resourceName
 		}
 	}
+	if v3c.mode == xdsclient.TransportModeDelta {
+		v3c.queueDeltaSubscriptionLocked(resourceType, resourceName, true)
+	}
 	v3c.mu.Unlock()
 	v3c.TransportHelper.AddWatch(resourceType, resourceName)
 }
@@ -125,12 +158,35 @@ func (v3c *client) RemoveWatch(resourceType, resourceName string) {
 			v3c.ldsResourceName = ""
 		}
 	}
+	if v3c.mode == xdsclient.TransportModeDelta {
+		v3c.queueDeltaSubscriptionLocked(resourceType, resourceName, false)
+	}
 	v3c.mu.Unlock()
 	v3c.TransportHelper.RemoveWatch(resourceType, resourceName)
 }
 
+// queueDeltaSubscriptionLocked records resourceName as newly (un)subscribed
+// for typeURL, to be sent as ResourceNamesSubscribe/ResourceNamesUnsubscribe
+// on the next delta request for that type. v3c.mu must be held.
+func (v3c *client) queueDeltaSubscriptionLocked(typeURL, resourceName string, subscribe bool) {
+	if v3c.pendingSubscriptions == nil {
+		v3c.pendingSubscriptions = make(map[string][]string)
+	}
+	if v3c.pendingUnsubscriptions == nil {
+		v3c.pendingUnsubscriptions = make(map[string][]string)
+	}
+	if subscribe {
+		v3c.pendingSubscriptions[typeURL] = append(v3c.pendingSubscriptions[typeURL], resourceName)
+	} else {
+		v3c.pendingUnsubscriptions[typeURL] = append(v3c.pendingUnsubscriptions[typeURL], resourceName)
+	}
+}
+
 func (v3c *client) NewStream(ctx context.Context) (grpc.ClientStream, error) {
-	return v3adsgrpc.NewAggregatedDiscoveryServiceClient(v3c.cc).StreamAggregatedResources(v3c.ctx, grpc.WaitForReady(true))
+	if v3c.mode == xdsclient.TransportModeDelta {
+		return v3adsgrpc.NewAggregatedDiscoveryServiceClient(v3c.cc).DeltaAggregatedResources(ctx, grpc.WaitForReady(true))
+	}
+	return v3adsgrpc.NewAggregatedDiscoveryServiceClient(v3c.cc).StreamAggregatedResources(ctx, grpc.WaitForReady(true))
 }
 
 // sendRequest sends a request for provided typeURL and resource on the provided
@@ -142,7 +198,12 @@ func (v3c *client) NewStream(ctx context.Context) (grpc.ClientStream, error) {
 // - If this is an ack, version will be the version from the response
 // - If this is a nack, version will be the previous acked version (from
 // versionMap). If there was no ack before, it will be an empty string
-func (v3c *client) SendRequest(s grpc.ClientStream, resourceNames []string, typeURL, version, nonce string) error {
+//
+// nackErr is the validation error that caused this to be a nack, and is nil
+// for new requests and acks. When non-nil, it is surfaced to the management
+// server as the request's ErrorDetail so it has more to go on than a version
+// mismatch.
+func (v3c *client) SendRequest(s grpc.ClientStream, resourceNames []string, typeURL, version, nonce string, nackErr error) error {
 	stream, ok := s.(adsStream)
 	if !ok {
 		return fmt.Errorf("xds: Attempt to send request on unsupported stream type: %T", s)
@@ -153,7 +214,7 @@ func (v3c *client) SendRequest(s grpc.ClientStream, resourceNames []string, type
 		ResourceNames: resourceNames,
 		VersionInfo:   version,
 		ResponseNonce: nonce,
-		// TODO: populate ErrorDetails for nack.
+		ErrorDetail:   errorDetailForNack(nackErr),
 	}
 	if err := stream.Send(req); err != nil {
 		return fmt.Errorf("xds: stream.Send(%+v) failed: %v", req, err)
@@ -162,6 +223,71 @@ func (v3c *client) SendRequest(s grpc.ClientStream, resourceNames []string, type
 	return nil
 }
 
+// SendDeltaRequest sends a DeltaDiscoveryRequest for the provided typeURL on
+// the provided stream. It pulls any subscribe/unsubscribe names queued by
+// AddWatch/RemoveWatch since the last request for this type, and, when the
+// stream was just (re)established, populates InitialResourceVersions from
+// the versions cached from before the disconnect so the server can send us
+// only what changed. nackErr is the validation error that caused this to be
+// a nack, and is nil for new requests and acks; see SendRequest.
+func (v3c *client) SendDeltaRequest(s grpc.ClientStream, typeURL, nonce string, initialStream bool, nackErr error) error {
+	stream, ok := s.(deltaAdsStream)
+	if !ok {
+		return fmt.Errorf("xds: Attempt to send delta request on unsupported stream type: %T", s)
+	}
+
+	v3c.mu.Lock()
+	subscribe := v3c.pendingSubscriptions[typeURL]
+	unsubscribe := v3c.pendingUnsubscriptions[typeURL]
+	delete(v3c.pendingSubscriptions, typeURL)
+	delete(v3c.pendingUnsubscriptions, typeURL)
+	var initialVersions map[string]string
+	if initialStream {
+		initialVersions = v3c.resourceVersions[typeURL]
+	}
+	v3c.mu.Unlock()
+
+	req := &v3discoverypb.DeltaDiscoveryRequest{
+		Node:                     v3c.nodeProto,
+		TypeUrl:                  typeURL,
+		ResourceNamesSubscribe:   subscribe,
+		ResourceNamesUnsubscribe: unsubscribe,
+		InitialResourceVersions:  initialVersions,
+		ResponseNonce:            nonce,
+		ErrorDetail:              errorDetailForNack(nackErr),
+	}
+	if err := stream.Send(req); err != nil {
+		return fmt.Errorf("xds: stream.Send(%+v) failed: %v", req, err)
+	}
+	v3c.logger.Debugf("ADS delta request sent: %v", req)
+	return nil
+}
+
+// errorDetailForNack builds the google.rpc.Status to set on a DiscoveryRequest
+// or DeltaDiscoveryRequest's ErrorDetail field from the resource validation
+// error that caused the nack. It returns nil for acks and new requests
+// (nackErr == nil), in which case ErrorDetail is left unset, per the xDS
+// transport protocol.
+func errorDetailForNack(nackErr error) *status.Status {
+	if nackErr == nil {
+		return nil
+	}
+	return &status.Status{
+		Code:    int32(codes.InvalidArgument),
+		Message: nackErr.Error(),
+	}
+}
+
+// isShutdownErr reports whether err from a broken ADS stream is just the
+// expected result of the stream's context being canceled by Close, as
+// opposed to a genuine transport failure that watchers need to be told
+// about. A canceled context surfaces from stream.Recv as a status error with
+// codes.Canceled, not as context.Canceled itself, so errors.Is alone isn't
+// enough to catch it.
+func isShutdownErr(err error) bool {
+	return grpcstatus.Code(err) == codes.Canceled || errors.Is(err, context.Canceled)
+}
+
 // RecvResponse blocks on the receipt of one response message on the provided
 // stream.
 func (v3c *client) RecvResponse(s grpc.ClientStream) (proto.Message, error) {
@@ -172,7 +298,16 @@ func (v3c *client) RecvResponse(s grpc.ClientStream) (proto.Message, error) {
 
 	resp, err := stream.Recv()
 	if err != nil {
-		// TODO: call watch callbacks with error when stream is broken.
+		// The stream has broken, and TransportHelper is about to back off and
+		// reconnect. Notify the parent so that watchers of every currently
+		// watched resource type see the error instead of silently keeping
+		// stale state until the reconnect (and subsequent response) arrives.
+		// Skip the notification if this is just the stream unwinding because
+		// the client itself was shut down; that's an expected, clean
+		// teardown, not a transport failure watchers need to react to.
+		if !isShutdownErr(err) {
+			v3c.parent.OnStreamError(err)
+		}
 		return nil, fmt.Errorf("xds: stream.Recv() failed: %v", err)
 	}
 	v3c.logger.Infof("ADS response received, type: %v", resp.GetTypeUrl())
@@ -180,6 +315,29 @@ func (v3c *client) RecvResponse(s grpc.ClientStream) (proto.Message, error) {
 	return resp, nil
 }
 
+// RecvDeltaResponse blocks on the receipt of one delta response message on
+// the provided stream.
+func (v3c *client) RecvDeltaResponse(s grpc.ClientStream) (proto.Message, error) {
+	stream, ok := s.(deltaAdsStream)
+	if !ok {
+		return nil, fmt.Errorf("xds: Attempt to receive delta response on unsupported stream type: %T", s)
+	}
+
+	resp, err := stream.Recv()
+	if err != nil {
+		// See the comment in RecvResponse: surface the broken stream to
+		// watchers rather than dropping it, unless this is just a clean
+		// shutdown.
+		if !isShutdownErr(err) {
+			v3c.parent.OnStreamError(err)
+		}
+		return nil, fmt.Errorf("xds: stream.Recv() failed: %v", err)
+	}
+	v3c.logger.Infof("ADS delta response received, type: %v", resp.GetTypeUrl())
+	v3c.logger.Debugf("ADS delta response received: %v", resp)
+	return resp, nil
+}
+
 func (v3c *client) HandleResponse(r proto.Message) (string, string, string, error) {
 	resp, ok := r.(*v3discoverypb.DiscoveryResponse)
 	if !ok {
@@ -208,6 +366,135 @@ func (v3c *client) HandleResponse(r proto.Message) (string, string, string, erro
 	return resp.GetTypeUrl(), resp.GetVersionInfo(), resp.GetNonce(), err
 }
 
+// HandleDeltaResponse processes a DeltaDiscoveryResponse received from the
+// xDS server. It merges the added/updated Resources and the RemovedResources
+// into the cached per-type view before handing the resulting full,
+// post-removal set of resources to the same per-resource-type handlers used
+// by the SotW path, since watchers still expect to see the complete, up to
+// date set of resources rather than only whatever changed in this response.
+// When such a response is accepted and names RemovedResources, the parent is
+// also told of the removal through OnStreamError.
+func (v3c *client) HandleDeltaResponse(r proto.Message) (string, string, error) {
+	resp, ok := r.(*v3discoverypb.DeltaDiscoveryResponse)
+	if !ok {
+		return "", "", fmt.Errorf("xds: unsupported message type: %T", resp)
+	}
+
+	typeURL := resp.GetTypeUrl()
+	resources, versions, cache := v3c.mergeDeltaResponse(typeURL, resp)
+
+	var err error
+	switch typeURL {
+	case version.V2ListenerURL, version.V3ListenerURL:
+		err = v3c.handleLDSDeltaResponse(resources)
+	case version.V2RouteConfigURL, version.V3RouteConfigURL:
+		err = v3c.handleRDSDeltaResponse(resources)
+	case version.V2ClusterURL, version.V3ClusterURL:
+		err = v3c.handleCDSDeltaResponse(resources)
+	case version.V2EndpointsURL, version.V3EndpointsURL:
+		err = v3c.handleEDSDeltaResponse(resources)
+	default:
+		return "", "", xdsclient.ErrResourceTypeUnsupported{
+			ErrStr: fmt.Sprintf("Resource type %v unknown in response from server", typeURL),
+		}
+	}
+	if err == nil {
+		v3c.mu.Lock()
+		v3c.resourceVersions[typeURL] = versions
+		v3c.resourceCache[typeURL] = cache
+		v3c.mu.Unlock()
+		if removed := resp.GetRemovedResources(); len(removed) > 0 {
+			v3c.parent.OnStreamError(fmt.Errorf("xds: management server removed %v resources %v", typeURL, removed))
+		}
+	}
+	return typeURL, resp.GetNonce(), err
+}
+
+// mergeDeltaResponse merges resp's added/updated Resources and
+// RemovedResources into copies of the per-type resource and version caches,
+// leaving the caches themselves untouched, and returns the resulting full set
+// of live resource protos (with anything in RemovedResources genuinely
+// absent, not just unmentioned) along with the updated version and resource
+// caches to store for typeURL.
+func (v3c *client) mergeDeltaResponse(typeURL string, resp *v3discoverypb.DeltaDiscoveryResponse) ([]*anypb.Any, map[string]string, map[string]*anypb.Any) {
+	v3c.mu.Lock()
+	cachedVersions := v3c.resourceVersions[typeURL]
+	cachedResources := v3c.resourceCache[typeURL]
+	v3c.mu.Unlock()
+
+	versions := make(map[string]string, len(cachedVersions))
+	for name, ver := range cachedVersions {
+		versions[name] = ver
+	}
+	resources := make(map[string]*anypb.Any, len(cachedResources))
+	for name, r := range cachedResources {
+		resources[name] = r
+	}
+
+	for _, name := range resp.GetRemovedResources() {
+		delete(versions, name)
+		delete(resources, name)
+	}
+	for _, r := range resp.GetResources() {
+		versions[r.GetName()] = r.GetVersion()
+		resources[r.GetName()] = r.GetResource()
+	}
+
+	all := make([]*anypb.Any, 0, len(resources))
+	for _, r := range resources {
+		all = append(all, r)
+	}
+	return all, versions, resources
+}
+
+// handleLDSDeltaResponse processes the full, post-removal set of LDS
+// resources for the delta path.
+func (v3c *client) handleLDSDeltaResponse(resources []*anypb.Any) error {
+	update, err := xdsclient.UnmarshalListener(resources, v3c.logger)
+	if err != nil {
+		return err
+	}
+	v3c.parent.NewListeners(update)
+	return nil
+}
+
+// handleRDSDeltaResponse processes the full, post-removal set of RDS
+// resources for the delta path.
+func (v3c *client) handleRDSDeltaResponse(resources []*anypb.Any) error {
+	v3c.mu.Lock()
+	hostname := v3c.ldsResourceName
+	v3c.mu.Unlock()
+
+	update, err := xdsclient.UnmarshalRouteConfig(resources, hostname, v3c.logger)
+	if err != nil {
+		return err
+	}
+	v3c.parent.NewRouteConfigs(update)
+	return nil
+}
+
+// handleCDSDeltaResponse processes the full, post-removal set of CDS
+// resources for the delta path.
+func (v3c *client) handleCDSDeltaResponse(resources []*anypb.Any) error {
+	update, err := xdsclient.UnmarshalCluster(resources, v3c.logger)
+	if err != nil {
+		return err
+	}
+	v3c.parent.NewClusters(update)
+	return nil
+}
+
+// handleEDSDeltaResponse processes the full, post-removal set of EDS
+// resources for the delta path.
+func (v3c *client) handleEDSDeltaResponse(resources []*anypb.Any) error {
+	update, err := xdsclient.UnmarshalEndpoints(resources, v3c.logger)
+	if err != nil {
+		return err
+	}
+	v3c.parent.NewEndpoints(update)
+	return nil
+}
+
 // handleLDSResponse processes an LDS response received from the xDS server. On
 // receipt of a good response, it also invokes the registered watcher callback.
 func (v3c *client) handleLDSResponse(resp *v3discoverypb.DiscoveryResponse) error {
@@ -253,4 +540,4 @@ func (v3c *client) handleEDSResponse(resp *v3discoverypb.DiscoveryResponse) erro
 	}
 	v3c.parent.NewEndpoints(update)
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,236 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package v3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	anypb "github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	xdsclient "google.golang.org/grpc/xds/internal/client"
+	"google.golang.org/grpc/xds/internal/version"
+
+	v3discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// TestIsShutdownErr verifies that isShutdownErr reports true both for a bare
+// context.Canceled and for the codes.Canceled status error a real gRPC
+// stream.Recv returns when its context is canceled - the shape Close()
+// actually produces - and false for any other transport failure, even one
+// that happens to share the "context canceled" text without being either.
+func TestIsShutdownErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "context.Canceled error", err: context.Canceled, want: true},
+		{name: "wrapped context.Canceled", err: fmt.Errorf("stream.Recv() failed: %w", context.Canceled), want: true},
+		{name: "grpc status Canceled", err: grpcstatus.Error(codes.Canceled, "context canceled"), want: true},
+		{name: "unrelated transport failure", err: errors.New("connection reset by peer"), want: false},
+		{name: "unrelated grpc status", err: grpcstatus.Error(codes.Unavailable, "connection reset by peer"), want: false},
+		{name: "plain error with context canceled text", err: errors.New("context canceled"), want: false},
+	}
+	for _, tt := range tests {
+		if got := isShutdownErr(tt.err); got != tt.want {
+			t.Errorf("%s: isShutdownErr() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestErrorDetailForNack verifies that a non-nil nackErr is turned into a
+// google.rpc.Status carrying the validation error's message, and that acks
+// and new requests (nackErr == nil) leave ErrorDetail unset.
+func TestErrorDetailForNack(t *testing.T) {
+	if got := errorDetailForNack(nil); got != nil {
+		t.Fatalf("errorDetailForNack(nil) = %v, want nil", got)
+	}
+
+	nackErr := errors.New("unsupported field foo in Listener bar")
+	got := errorDetailForNack(nackErr)
+	if got == nil {
+		t.Fatalf("errorDetailForNack(%v) = nil, want non-nil", nackErr)
+	}
+	if got.Code != int32(codes.InvalidArgument) {
+		t.Errorf("errorDetailForNack(%v).Code = %v, want %v", nackErr, got.Code, codes.InvalidArgument)
+	}
+	if got.Message != nackErr.Error() {
+		t.Errorf("errorDetailForNack(%v).Message = %q, want %q", nackErr, got.Message, nackErr.Error())
+	}
+}
+
+func newTestDeltaClient() *client {
+	return &client{
+		mode:             xdsclient.TransportModeDelta,
+		resourceVersions: make(map[string]map[string]string),
+		resourceCache:    make(map[string]map[string]*anypb.Any),
+	}
+}
+
+// TestMergeDeltaResponseAddUpdate verifies that newly added resources show up
+// in the merged set, and that re-adding a name with a new version overwrites
+// the previously cached resource rather than duplicating it.
+func TestMergeDeltaResponseAddUpdate(t *testing.T) {
+	v3c := newTestDeltaClient()
+	const typeURL = version.V3ListenerURL
+
+	resp := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Resources: []*v3discoverypb.Resource{
+			{Name: "foo", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL, Value: []byte("v1")}},
+			{Name: "bar", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL, Value: []byte("v1")}},
+		},
+	}
+	resources, versions, cache := v3c.mergeDeltaResponse(typeURL, resp)
+	if len(resources) != 2 {
+		t.Fatalf("got %d resources after initial add, want 2", len(resources))
+	}
+	if versions["foo"] != "1" || versions["bar"] != "1" {
+		t.Fatalf("unexpected versions after initial add: %+v", versions)
+	}
+	v3c.resourceVersions[typeURL] = versions
+	v3c.resourceCache[typeURL] = cache
+
+	// A follow-up response updates "foo" only; "bar" must survive untouched
+	// in the merged set since SotW watchers expect the full picture.
+	resp2 := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Resources: []*v3discoverypb.Resource{
+			{Name: "foo", Version: "2", Resource: &anypb.Any{TypeUrl: typeURL, Value: []byte("v2")}},
+		},
+	}
+	resources2, versions2, _ := v3c.mergeDeltaResponse(typeURL, resp2)
+	if len(resources2) != 2 {
+		t.Fatalf("got %d resources after update, want 2 (foo updated, bar unchanged)", len(resources2))
+	}
+	if versions2["foo"] != "2" {
+		t.Fatalf("got foo version %q, want 2", versions2["foo"])
+	}
+	if versions2["bar"] != "1" {
+		t.Fatalf("got bar version %q, want unchanged 1", versions2["bar"])
+	}
+}
+
+// TestMergeDeltaResponseRemoved verifies that a resource named in
+// RemovedResources is dropped from the merged set and from the cached
+// versions, so a subsequent reconnect won't claim to still have it.
+func TestMergeDeltaResponseRemoved(t *testing.T) {
+	v3c := newTestDeltaClient()
+	const typeURL = version.V3ClusterURL
+
+	resp := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Resources: []*v3discoverypb.Resource{
+			{Name: "foo", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL}},
+			{Name: "bar", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL}},
+		},
+	}
+	_, versions, cache := v3c.mergeDeltaResponse(typeURL, resp)
+	v3c.resourceVersions[typeURL] = versions
+	v3c.resourceCache[typeURL] = cache
+
+	resp2 := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl:          typeURL,
+		RemovedResources: []string{"bar"},
+	}
+	resources2, versions2, _ := v3c.mergeDeltaResponse(typeURL, resp2)
+	if len(resources2) != 1 {
+		t.Fatalf("got %d resources after removal, want 1", len(resources2))
+	}
+	if _, ok := versions2["bar"]; ok {
+		t.Fatalf("removed resource %q still present in version cache", "bar")
+	}
+	if _, ok := versions2["foo"]; !ok {
+		t.Fatalf("unrelated resource %q dropped by removal of another name", "foo")
+	}
+}
+
+// TestMergeDeltaResponseMixedAddRemove verifies that a single response
+// carrying both added/updated and removed resources applies both correctly.
+func TestMergeDeltaResponseMixedAddRemove(t *testing.T) {
+	v3c := newTestDeltaClient()
+	const typeURL = version.V3EndpointsURL
+
+	seed := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Resources: []*v3discoverypb.Resource{
+			{Name: "a", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL}},
+			{Name: "b", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL}},
+		},
+	}
+	_, versions, cache := v3c.mergeDeltaResponse(typeURL, seed)
+	v3c.resourceVersions[typeURL] = versions
+	v3c.resourceCache[typeURL] = cache
+
+	mixed := &v3discoverypb.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+		Resources: []*v3discoverypb.Resource{
+			{Name: "c", Version: "1", Resource: &anypb.Any{TypeUrl: typeURL}},
+		},
+		RemovedResources: []string{"a"},
+	}
+	resources, versions2, _ := v3c.mergeDeltaResponse(typeURL, mixed)
+	gotNames := map[string]bool{}
+	for name := range versions2 {
+		gotNames[name] = true
+	}
+	if len(resources) != 2 || gotNames["a"] || !gotNames["b"] || !gotNames["c"] {
+		t.Fatalf("mixed add/remove not applied correctly, got names: %+v", gotNames)
+	}
+}
+
+// TestQueueDeltaSubscriptionResubscribe verifies that
+// queueDeltaSubscriptionLocked, which AddWatch/RemoveWatch use in delta mode,
+// queues names to be subscribed/unsubscribed on the next delta request of
+// their type, and that versions stored in resourceVersions, the map
+// SendDeltaRequest seeds InitialResourceVersions from on a new stream, are
+// kept alongside the queued names. It does not open or reconnect a stream.
+func TestQueueDeltaSubscriptionResubscribe(t *testing.T) {
+	v3c := newTestDeltaClient()
+	const typeURL = version.V3RouteConfigURL
+
+	v3c.mu.Lock()
+	v3c.queueDeltaSubscriptionLocked(typeURL, "route-a", true)
+	v3c.queueDeltaSubscriptionLocked(typeURL, "route-b", true)
+	v3c.mu.Unlock()
+
+	if got := v3c.pendingSubscriptions[typeURL]; len(got) != 2 {
+		t.Fatalf("pendingSubscriptions[%s] = %v, want 2 queued names", typeURL, got)
+	}
+
+	// Simulate a good response having been cached before the stream broke.
+	v3c.resourceVersions[typeURL] = map[string]string{"route-a": "5", "route-b": "5"}
+
+	// The pre-disconnect versions stay available to seed
+	// InitialResourceVersions with, alongside what's queued to subscribe.
+	if got := v3c.resourceVersions[typeURL]["route-a"]; got != "5" {
+		t.Fatalf("resourceVersions[%s][route-a] = %q, want 5 (preserved across reconnect)", typeURL, got)
+	}
+
+	v3c.mu.Lock()
+	v3c.queueDeltaSubscriptionLocked(typeURL, "route-b", false)
+	v3c.mu.Unlock()
+	if got := v3c.pendingUnsubscriptions[typeURL]; len(got) != 1 || got[0] != "route-b" {
+		t.Fatalf("pendingUnsubscriptions[%s] = %v, want [route-b]", typeURL, got)
+	}
+}